@@ -0,0 +1,34 @@
+package quic
+
+import (
+	"errors"
+	"net"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+var errClosed = errors.New("stream closed")
+
+// conn adapts a QUIC stream, plus the session it belongs to, into a
+// net.Conn so that the existing filter chain (tokenfilter,
+// versioncheck, tunnelportsfilter) can operate on it exactly as it
+// does on a TLS or plain TCP connection.
+type conn struct {
+	*safeStream
+	session quic.Session
+}
+
+func newConn(session quic.Session, stream quic.Stream) net.Conn {
+	return &conn{
+		safeStream: newSafeStream(stream),
+		session:    session,
+	}
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.session.LocalAddr()
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.session.RemoteAddr()
+}
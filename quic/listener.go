@@ -0,0 +1,66 @@
+// Package quic provides a CONNECT-style tunnel transport over HTTP/3 /
+// raw QUIC streams, for use by mobile clients on lossy networks that
+// benefit from multiplexing many CONNECTs over a single UDP
+// connection.
+//
+// Each accepted stream is wrapped in a safeStream so that it can be
+// handed to the existing HTTP filter chain (tokenfilter, versioncheck,
+// tunnelportsfilter) as a plain io.ReadWriteCloser, unaware that it is
+// actually running over QUIC.
+package quic
+
+import (
+	"context"
+	"net"
+
+	"github.com/getlantern/golog"
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+var log = golog.LoggerFor("quic")
+
+// Handler processes a single tunnelled CONNECT stream, such as an
+// http.Server's connection handler adapted to run on a net.Conn.
+type Handler func(net.Conn)
+
+// Serve accepts sessions from ql and, for every stream opened on any
+// of them, invokes handler with a net.Conn wrapping that stream. It
+// blocks until ql is closed or its Accept otherwise returns an error.
+//
+// A session may live far longer than any single stream and carry many
+// concurrent CONNECTs, so streams are served independently of one
+// another and of the session itself: handler returning (because the
+// client<->origin copy finished in either direction) only tears down
+// that one stream via conn.Close, which serializes with any in-flight
+// Write and cancels the read-side so the stream's buffers are
+// reclaimed immediately rather than lingering until the session ends.
+func Serve(ql quic.Listener, handler Handler) error {
+	for {
+		session, err := ql.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go serveSession(session, handler)
+	}
+}
+
+func serveSession(session quic.Session, handler Handler) {
+	for {
+		stream, err := session.AcceptStream(context.Background())
+		if err != nil {
+			log.Debugf("Session %v no longer accepting streams: %v", session.RemoteAddr(), err)
+			return
+		}
+		go serveStream(session, stream, handler)
+	}
+}
+
+// serveStream runs handler on the stream and guarantees that, no
+// matter which direction of the tunnel finishes (or panics) first,
+// the stream is closed exactly once so both the send and receive
+// sides are released.
+func serveStream(session quic.Session, stream quic.Stream, handler Handler) {
+	c := newConn(session, stream)
+	defer c.Close()
+	handler(c)
+}
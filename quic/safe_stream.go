@@ -0,0 +1,58 @@
+package quic
+
+import (
+	"sync"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// safeStream wraps a quic.Stream to make it safe for the proxy's
+// filter chain to use as an io.ReadWriteCloser. quic-go does not allow
+// Close to be called concurrently with Write, and Close alone only
+// shuts down the send-side of the stream, so readers left on the
+// receive-side would otherwise block until the whole QUIC session is
+// torn down. safeStream serializes Write/Close and explicitly cancels
+// the read-side so both directions are released together.
+type safeStream struct {
+	quic.Stream
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newSafeStream(s quic.Stream) *safeStream {
+	return &safeStream{Stream: s}
+}
+
+func (s *safeStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, errClosed
+	}
+	return s.Stream.Write(b)
+}
+
+// Close shuts down the send-side of the stream and cancels the
+// receive-side so that any goroutine blocked on Read returns
+// immediately instead of waiting for the peer or the session to go
+// away. It is safe to call Close more than once or concurrently with
+// Write.
+//
+// CancelWrite is called before mu is acquired, not after: Write holds
+// mu for the duration of the underlying Stream.Write, which blocks on
+// QUIC flow control if the peer stalls. Canceling the write side first
+// unblocks that in-flight Write (and its hold on mu) so Close can
+// always preempt a stuck Write instead of waiting on it forever.
+func (s *safeStream) Close() error {
+	s.Stream.CancelWrite(0)
+	s.Stream.CancelRead(0)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.Stream.Close()
+}
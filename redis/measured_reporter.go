@@ -20,95 +20,187 @@ type statsAndContext struct {
 	stats *measured.Stats
 }
 
-func NewMeasuredReporter(rc *redis.Client, reportInterval time.Duration) listeners.MeasuredReportFN {
+// NewMeasuredReporter returns a listeners.MeasuredReportFN that batches
+// per-device stats deltas and submits them to Redis every
+// reportInterval. If the in-memory buffer between callers and the
+// submission goroutine saturates - because Redis is slow or
+// unreachable - deltas are spilled to an on-disk queue under spillDir
+// instead of being dropped. Spilled deltas are replayed once at
+// startup and again after every submit that succeeds at runtime, so a
+// slow-Redis episode doesn't strand them on disk until the next
+// restart. Pass an empty spillDir to disable spilling and fall back to
+// dropping stats on a full buffer, as before.
+func NewMeasuredReporter(rc *redis.Client, reportInterval time.Duration, spillDir string) listeners.MeasuredReportFN {
 	// Provide some buffering so that we don't lose data while submitting to Redis
 	statsCh := make(chan *statsAndContext, 10000)
-	go reportPeriodically(rc, reportInterval, statsCh)
+	queue, err := newSpillQueue(spillDir)
+	if err != nil {
+		log.Errorf("Unable to open stats spill queue at %v, stats will be dropped if Redis submission falls behind: %v", spillDir, err)
+		queue = nil
+	}
+	go reportPeriodically(rc, reportInterval, statsCh, queue)
 	return func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+		sac := &statsAndContext{ctx, deltaStats}
 		select {
-		case statsCh <- &statsAndContext{ctx, deltaStats}:
-			// submitted successfully
+		case statsCh <- sac:
+			statsEnqueued.Inc()
 		default:
-			// data lost, probably because Redis submission is taking longer than expected
+			if queue == nil {
+				statsDropped.Inc()
+				return
+			}
+			if err := queue.Append(sac); err != nil {
+				log.Errorf("Unable to spill stats to disk, dropping: %v", err)
+				statsDropped.Inc()
+				return
+			}
+			statsSpilledToDisk.Inc()
 		}
 	}
 }
 
-func reportPeriodically(rc *redis.Client, reportInterval time.Duration, statsCh chan (*statsAndContext)) {
+func reportPeriodically(rc *redis.Client, reportInterval time.Duration, statsCh chan (*statsAndContext), queue *spillQueue) {
 	sleepTime := time.Duration(rand.Int63n(time.Minute.Nanoseconds()))
 	log.Debugf("Randomly sleep %v before reporting traffic", sleepTime)
 	time.Sleep(sleepTime)
-	ticker := time.NewTicker(reportInterval)
+
 	statsByDeviceID := make(map[string]*measured.Stats)
+	if queue != nil {
+		if err := queue.Drain(func(sac *statsAndContext) {
+			mergeStats(statsByDeviceID, sac)
+		}); err != nil {
+			log.Errorf("Unable to fully drain stats spilled by a previous run, some may be resubmitted later: %v", err)
+		}
+	}
+
+	ticker := time.NewTicker(reportInterval)
 
 	for {
 		select {
 		case sac := <-statsCh:
-			_deviceID := sac.ctx["deviceid"]
-			if _deviceID == nil {
-				// ignore
-				continue
-			}
-			deviceID := _deviceID.(string)
-			existing := statsByDeviceID[deviceID]
-			if existing == nil {
-				existing = sac.stats
-				statsByDeviceID[deviceID] = existing
-			} else {
-				existing.SentTotal += sac.stats.SentTotal
-				existing.RecvTotal += sac.stats.RecvTotal
-			}
+			mergeStats(statsByDeviceID, sac)
 		case <-ticker.C:
 			if log.IsTraceEnabled() {
 				log.Tracef("Submitting %d stats", len(statsByDeviceID))
 			}
-			err := submit(rc, statsByDeviceID)
-			if err != nil {
-				log.Errorf("Unable to submit stats: %v", err)
+			if err := submit(rc, statsByDeviceID); err != nil {
+				log.Errorf("Unable to submit stats, will retry with next batch: %v", err)
+				continue
 			}
 			// Reset stats
 			statsByDeviceID = make(map[string]*measured.Stats)
+			// Now that a submit has actually succeeded, Redis (or
+			// whatever was keeping submit failing) has recovered, so
+			// replay anything a prior slow/unreachable-Redis episode
+			// spilled to disk back into this round instead of leaving it
+			// stranded on disk until the process restarts. Drain is a
+			// no-op if nothing spilled, so it's cheap to call every tick.
+			if queue != nil {
+				if err := queue.Drain(func(sac *statsAndContext) {
+					mergeStats(statsByDeviceID, sac)
+				}); err != nil {
+					log.Errorf("Unable to fully drain spilled stats, some may be resubmitted later: %v", err)
+				}
+			}
 		}
 	}
 }
 
+func mergeStats(statsByDeviceID map[string]*measured.Stats, sac *statsAndContext) {
+	_deviceID := sac.ctx["deviceid"]
+	if _deviceID == nil {
+		// ignore
+		return
+	}
+	deviceID := _deviceID.(string)
+	existing := statsByDeviceID[deviceID]
+	if existing == nil {
+		statsByDeviceID[deviceID] = sac.stats
+		return
+	}
+	existing.SentTotal += sac.stats.SentTotal
+	existing.RecvTotal += sac.stats.RecvTotal
+}
+
+// submit batches all of this round's HIncrBy/ExpireAt calls into a
+// single redis.Pipeline instead of one Multi/Exec per device, to cut
+// round-trips, and retries the pipeline with exponential backoff and
+// jitter if Exec fails.
 func submit(rc *redis.Client, statsByDeviceID map[string]*measured.Stats) error {
-	now := time.Now()
-	nextMonth := now.Month() + 1
-	nextYear := now.Year()
-	if nextMonth > time.December {
-		nextMonth = time.January
-		nextYear++
+	if len(statsByDeviceID) == 0 {
+		return nil
 	}
-	beginningOfNextMonth := time.Date(nextYear, nextMonth, 1, 0, 0, 0, 0, now.Location())
-	endOfThisMonth := beginningOfNextMonth.Add(-1 * time.Nanosecond)
-	for deviceID, stats := range statsByDeviceID {
-		multi := rc.Multi()
-		var bytesInOp *redis.IntCmd
-		var bytesOutOp *redis.IntCmd
-		_, merr := multi.Exec(func() error {
+
+	start := time.Now()
+	defer func() { redisSubmitSeconds.Observe(time.Since(start).Seconds()) }()
+
+	now := time.Now()
+	endOfThisMonth := endOfMonth(now)
+
+	// gopkg.in/redis.v3's Pipeline consumes its queued commands on the
+	// first Exec, so a retry has to rebuild and re-queue every command
+	// from scratch rather than re-running the same *redis.Pipeline -
+	// otherwise a retry after a transient failure "succeeds" against an
+	// empty pipeline without ever resubmitting anything.
+	var bytesInOps, bytesOutOps map[string]*redis.IntCmd
+	buildAndExec := func() error {
+		pipe := rc.Pipeline()
+		defer pipe.Close()
+
+		bytesInOps = make(map[string]*redis.IntCmd, len(statsByDeviceID))
+		bytesOutOps = make(map[string]*redis.IntCmd, len(statsByDeviceID))
+		for deviceID, stats := range statsByDeviceID {
 			clientKey := "_client:" + deviceID
-			// If any of these commands fails, the error will be immediately returned by Exec,
-			// so we shouldn't be checking them here. Also, reifying the values should be done
-			// after the Exec is done and we've checked for errors running it.
-			bytesInOp = multi.HIncrBy(clientKey, "bytesIn", int64(stats.RecvTotal))
-			bytesOutOp = multi.HIncrBy(clientKey, "bytesOut", int64(stats.SentTotal))
+			bytesInOps[deviceID] = pipe.HIncrBy(clientKey, "bytesIn", int64(stats.RecvTotal))
+			bytesOutOps[deviceID] = pipe.HIncrBy(clientKey, "bytesOut", int64(stats.SentTotal))
 			// If the time of proxy is ahead of Redis, this may sets the expiry
 			// to end of the next month before Redis expires the key.
 			// As a supplement, lantern_aws has a cronjob
 			// salt/cronner/reset_bandwidth_data.py to delete all client keys
 			// at the beginning of each month.
-			multi.ExpireAt(clientKey, endOfThisMonth)
-			return nil
-		})
-		multi.Close()
-		if merr != nil {
-			return merr
+			pipe.ExpireAt(clientKey, endOfThisMonth)
 		}
+		_, err := pipe.Exec()
+		return err
+	}
+
+	if err := execWithRetry(buildAndExec); err != nil {
+		return err
+	}
 
-		bytesIn := bytesInOp.Val()
-		bytesOut := bytesOutOp.Val()
+	for deviceID := range statsByDeviceID {
+		bytesIn := bytesInOps[deviceID].Val()
+		bytesOut := bytesOutOps[deviceID].Val()
 		usage.Set(deviceID, uint64(bytesIn+bytesOut), now)
 	}
 	return nil
 }
+
+func endOfMonth(now time.Time) time.Time {
+	nextMonth := now.Month() + 1
+	nextYear := now.Year()
+	if nextMonth > time.December {
+		nextMonth = time.January
+		nextYear++
+	}
+	beginningOfNextMonth := time.Date(nextYear, nextMonth, 1, 0, 0, 0, 0, now.Location())
+	return beginningOfNextMonth.Add(-1 * time.Nanosecond)
+}
+
+const maxSubmitAttempts = 5
+
+// execWithRetry calls attempt, which should build and execute a fresh
+// redis.Pipeline from scratch, retrying with exponential backoff and
+// jitter if it fails.
+func execWithRetry(attempt func() error) error {
+	var err error
+	for i := 0; i < maxSubmitAttempts; i++ {
+		if err = attempt(); err == nil {
+			return nil
+		}
+		backoff := (1 << uint(i)) * 100 * time.Millisecond
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		time.Sleep(sleep)
+	}
+	return err
+}
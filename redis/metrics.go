@@ -0,0 +1,26 @@
+package redis
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	statsEnqueued = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "stats_enqueued",
+		Help: "Number of per-device stats deltas enqueued for submission to Redis",
+	})
+	statsSpilledToDisk = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "stats_spilled_to_disk",
+		Help: "Number of stats deltas written to the on-disk spill queue because the in-memory channel was full",
+	})
+	statsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "stats_dropped",
+		Help: "Number of stats deltas dropped entirely, without being submitted or spilled to disk",
+	})
+	redisSubmitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "redis_submit_seconds",
+		Help: "Time spent submitting a batch of per-device stats to Redis",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(statsEnqueued, statsSpilledToDisk, statsDropped, redisSubmitSeconds)
+}
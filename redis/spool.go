@@ -0,0 +1,136 @@
+package redis
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/measured"
+)
+
+// maxSegmentBytes caps how large a single spool segment is allowed to
+// grow before a new one is rotated in, so that Drain can process and
+// discard the backlog incrementally rather than holding it all in
+// memory at once.
+const maxSegmentBytes = 8 * 1024 * 1024
+
+// spillQueue is a segmented, append-only on-disk queue that holds
+// stats deltas arriving while the in-memory reporting channel is
+// saturated, so a slow or unreachable Redis doesn't silently cost
+// operators billing data. Entries are JSON-encoded, one per line.
+type spillQueue struct {
+	dir string
+
+	mu      sync.Mutex
+	file    *os.File
+	written int64
+}
+
+type spilledEntry struct {
+	Ctx   map[string]interface{} `json:"ctx"`
+	Stats *measured.Stats        `json:"stats"`
+}
+
+// newSpillQueue returns a spillQueue rooted at dir, creating it if
+// necessary. A blank dir disables spilling entirely (nil, nil).
+func newSpillQueue(dir string) (*spillQueue, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &spillQueue{dir: dir}, nil
+}
+
+// Append serializes sac to the current segment, rotating in a new one
+// first if the current segment has reached maxSegmentBytes.
+func (q *spillQueue) Append(sac *statsAndContext) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file == nil || q.written >= maxSegmentBytes {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(spilledEntry{sac.ctx, sac.stats})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	n, err := q.file.Write(b)
+	q.written += int64(n)
+	return err
+}
+
+func (q *spillQueue) rotate() error {
+	if q.file != nil {
+		q.file.Close()
+	}
+	f, err := os.Create(filepath.Join(q.dir, fmt.Sprintf("%d.spool", time.Now().UnixNano())))
+	if err != nil {
+		return err
+	}
+	q.file = f
+	q.written = 0
+	return nil
+}
+
+// Drain replays every previously spilled entry, oldest segment first,
+// to fn and removes each segment once it's been fully processed. It's
+// called once at startup to recover whatever a prior process couldn't
+// submit before exiting, and again after every submit that succeeds at
+// runtime to recover whatever the current process spilled during a
+// slow or unreachable Redis episode. It's cheap to call when there's
+// nothing spilled: Glob simply finds no segments.
+func (q *spillQueue) Drain(fn func(*statsAndContext)) error {
+	q.mu.Lock()
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+		q.written = 0
+	}
+	q.mu.Unlock()
+
+	segments, err := filepath.Glob(filepath.Join(q.dir, "*.spool"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(segments)
+
+	for _, path := range segments {
+		if err := q.drainSegment(path, fn); err != nil {
+			return fmt.Errorf("draining %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func (q *spillQueue) drainSegment(path string, fn func(*statsAndContext)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry spilledEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Errorf("Skipping corrupt spilled stats entry in %s: %v", path, err)
+			continue
+		}
+		fn(&statsAndContext{entry.Ctx, entry.Stats})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
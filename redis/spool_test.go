@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/measured"
+	"github.com/getlantern/testify/assert"
+)
+
+func TestSpillQueueAppendAndDrain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spillqueue")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newSpillQueue(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, q.Append(&statsAndContext{
+		ctx:   map[string]interface{}{"deviceid": "device-1"},
+		stats: &measured.Stats{SentTotal: 10, RecvTotal: 20},
+	}))
+	assert.NoError(t, q.Append(&statsAndContext{
+		ctx:   map[string]interface{}{"deviceid": "device-1"},
+		stats: &measured.Stats{SentTotal: 5, RecvTotal: 7},
+	}))
+
+	statsByDeviceID := make(map[string]*measured.Stats)
+	assert.NoError(t, q.Drain(func(sac *statsAndContext) {
+		mergeStats(statsByDeviceID, sac)
+	}))
+
+	assert.Equal(t, int64(15), statsByDeviceID["device-1"].SentTotal)
+	assert.Equal(t, int64(27), statsByDeviceID["device-1"].RecvTotal)
+
+	// Segments are removed once drained.
+	matches, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
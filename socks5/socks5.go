@@ -0,0 +1,376 @@
+// Package socks5 implements a minimal SOCKS5 (RFC 1928/1929) listener
+// so that a single proxy process can serve SOCKS5 clients alongside
+// the existing HTTP CONNECT proxy. It reuses the same token
+// authentication, allowed-ports enforcement and usage-reporting chain
+// as the HTTP path by synthesizing a CONNECT request for every SOCKS5
+// REQUEST and running it through the shared filters.Chain.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy-lantern/common"
+)
+
+var log = golog.LoggerFor("socks5")
+
+const (
+	socksVersion5 = 0x05
+
+	authNone         = 0x00
+	authPassword     = 0x02
+	authNoAcceptable = 0xff
+
+	passwordAuthVersion = 0x01
+
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	repSucceeded            = 0x00
+	repGeneralFailure       = 0x01
+	repConnNotAllowed       = 0x02
+	repCommandNotSupported  = 0x07
+	repAddrTypeNotSupported = 0x08
+
+	// lanternUsername is the fixed SOCKS5 username clients authenticate
+	// with; the real credential is the token carried in the password
+	// field, mirroring common.TokenHeader on the HTTP CONNECT path.
+	lanternUsername = "lantern"
+)
+
+// Option configures a Server. It follows the same functional-options
+// shape as tunnelportsfilter.AllowedPorts.
+type Option func(*Server)
+
+// AllowedPorts restricts which destination ports a SOCKS5 CONNECT may
+// target. Requests for any other port are rejected at the REQUEST
+// stage with reply code 0x02 (connection not allowed), mirroring the
+// HTTP path's 403 from tunnelportsfilter. A nil or empty list allows
+// all ports.
+func AllowedPorts(ports []int) Option {
+	return func(s *Server) {
+		s.allowedPorts = make(map[int]bool, len(ports))
+		for _, p := range ports {
+			s.allowedPorts[p] = true
+		}
+	}
+}
+
+// Server is a SOCKS5 listener that authenticates clients and enforces
+// allowed ports the same way the HTTP CONNECT proxy does, then hands
+// the resulting request to chain so that versioncheck and the redis
+// usage reporter see identical traffic regardless of which front-end
+// protocol it arrived over.
+type Server struct {
+	chain        filters.Chain
+	allowedPorts map[int]bool
+}
+
+// New constructs a Server that runs every authenticated CONNECT
+// through chain, exactly as the HTTP listener does.
+func New(chain filters.Chain, options ...Option) *Server {
+	s := &Server{chain: chain}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
+}
+
+// Serve accepts connections from l until it returns an error.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	token, err := s.authenticate(conn)
+	if err != nil {
+		log.Debugf("SOCKS5 auth from %v failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	// Standard SOCKS5 clients have no field to carry a real device id
+	// the way the HTTP CONNECT path's token header does, so derive a
+	// synthetic one from CONNECT-time connection metadata: the
+	// client's own remote address. This is enough for the redis
+	// reporter's per-device aggregation to key on, which otherwise
+	// drops any stat whose deviceid is unset.
+	deviceID := deviceIDFromAddr(conn.RemoteAddr())
+
+	host, port, udp, err := s.readRequest(conn)
+	if err != nil {
+		log.Debugf("SOCKS5 request from %v failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if udp {
+		// UDP ASSOCIATE has no relay implementation yet, so it's always
+		// rejected rather than accepted but silently dropping traffic.
+		// TODO(lantern): implement a UDP relay and accept this command.
+		writeReply(conn, repCommandNotSupported)
+		return
+	}
+
+	if len(s.allowedPorts) > 0 && !s.allowedPorts[port] {
+		log.Debugf("Rejecting SOCKS5 CONNECT to disallowed port %d from %v", port, conn.RemoteAddr())
+		writeReply(conn, repConnNotAllowed)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodConnect, "", nil)
+	if err != nil {
+		writeReply(conn, repGeneralFailure)
+		return
+	}
+	req.Host = net.JoinHostPort(host, strconv.Itoa(port))
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.Header.Set(common.TokenHeader, token)
+	req.Header.Set(common.DeviceIDHeader, deviceID)
+
+	ctx := filters.NewContext(conn)
+	resp, _, err := s.chain.Apply(ctx, req, func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		return s.connectAndRelay(ctx, conn, req.Host)
+	})
+	if err != nil {
+		log.Debugf("SOCKS5 tunnel to %s for %v failed: %v", req.Host, conn.RemoteAddr(), err)
+		return
+	}
+	if resp != nil {
+		// A filter upstream of connectAndRelay (tunnelportsfilter rejecting
+		// the destination, versioncheck blocking the client, ...) short
+		// circuited the chain with an HTTP response instead of reaching
+		// connectAndRelay, so no SOCKS5 reply has been written yet -
+		// translate its status into one rather than leaving the client
+		// with a bare TCP close.
+		writeReply(conn, socksReplyFor(resp.StatusCode))
+	}
+}
+
+// socksReplyFor maps the HTTP status code a rejecting filter responds
+// with to the SOCKS5 reply code that best describes it to the client.
+func socksReplyFor(statusCode int) byte {
+	switch statusCode {
+	case http.StatusForbidden:
+		return repConnNotAllowed
+	default:
+		return repGeneralFailure
+	}
+}
+
+// connectAndRelay dials target, acks the SOCKS5 request with the real
+// bind address once the dial succeeds, and then copies bytes between
+// conn and the origin in both directions until either side is done,
+// the same shape the HTTP CONNECT path's tunnel takes.
+func (s *Server) connectAndRelay(ctx filters.Context, conn net.Conn, target string) (*http.Response, filters.Context, error) {
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		log.Debugf("Unable to dial %v: %v", target, err)
+		writeReply(conn, repGeneralFailure)
+		return nil, ctx, err
+	}
+	defer upstream.Close()
+
+	bindIP, bindPort := hostPortFromAddr(upstream.LocalAddr())
+	if err := writeReplyAddr(conn, repSucceeded, bindIP, bindPort); err != nil {
+		return nil, ctx, err
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+
+	return nil, ctx, nil
+}
+
+// deviceIDFromAddr derives a synthetic per-client device id from a
+// connection's remote address.
+func deviceIDFromAddr(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// hostPortFromAddr extracts an IP and port from a net.Addr, as
+// returned by Conn.LocalAddr, for use in a SOCKS5 reply.
+func hostPortFromAddr(addr net.Addr) (net.IP, int) {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP, tcpAddr.Port
+	}
+	return net.IPv4zero, 0
+}
+
+// authenticate performs the SOCKS5 method negotiation and, assuming
+// the client offers username/password auth, the RFC 1929
+// sub-negotiation. The username must be lanternUsername; the password
+// is treated as the proxy token, mirroring common.TokenHeader on the
+// HTTP CONNECT path.
+func (s *Server) authenticate(conn net.Conn) (token string, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion5 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	offered := false
+	for _, m := range methods {
+		if m == authPassword {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion5, authNoAcceptable})
+		return "", errors.New("client did not offer username/password auth")
+	}
+	if _, err = conn.Write([]byte{socksVersion5, authPassword}); err != nil {
+		return "", err
+	}
+
+	authHeader := make([]byte, 2)
+	if _, err = io.ReadFull(conn, authHeader); err != nil {
+		return "", err
+	}
+	if authHeader[0] != passwordAuthVersion {
+		return "", fmt.Errorf("unsupported password auth version %d", authHeader[0])
+	}
+	username := make([]byte, authHeader[1])
+	if _, err = io.ReadFull(conn, username); err != nil {
+		return "", err
+	}
+	pwLen := make([]byte, 1)
+	if _, err = io.ReadFull(conn, pwLen); err != nil {
+		return "", err
+	}
+	password := make([]byte, pwLen[0])
+	if _, err = io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+
+	if string(username) != lanternUsername {
+		conn.Write([]byte{passwordAuthVersion, 0x01})
+		return "", fmt.Errorf("unexpected SOCKS5 username %q", username)
+	}
+
+	if _, err = conn.Write([]byte{passwordAuthVersion, 0x00}); err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+func (s *Server) readRequest(conn net.Conn) (host string, port int, udp bool, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return "", 0, false, err
+	}
+	if header[0] != socksVersion5 {
+		return "", 0, false, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	switch header[1] {
+	case cmdConnect:
+	case cmdUDPAssociate:
+		udp = true
+	default:
+		writeReply(conn, repCommandNotSupported)
+		return "", 0, false, fmt.Errorf("unsupported SOCKS5 command %d", header[1])
+	}
+
+	switch header[3] {
+	case atypIPv4:
+		addr := make([]byte, 4)
+		if _, err = io.ReadFull(conn, addr); err != nil {
+			return "", 0, false, err
+		}
+		host = net.IP(addr).String()
+	case atypDomain:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull(conn, l); err != nil {
+			return "", 0, false, err
+		}
+		domain := make([]byte, l[0])
+		if _, err = io.ReadFull(conn, domain); err != nil {
+			return "", 0, false, err
+		}
+		host = string(domain)
+	case atypIPv6:
+		addr := make([]byte, 16)
+		if _, err = io.ReadFull(conn, addr); err != nil {
+			return "", 0, false, err
+		}
+		host = net.IP(addr).String()
+	default:
+		writeReply(conn, repAddrTypeNotSupported)
+		return "", 0, false, fmt.Errorf("unsupported SOCKS5 address type %d", header[3])
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err = io.ReadFull(conn, portBytes); err != nil {
+		return "", 0, false, err
+	}
+	port = int(binary.BigEndian.Uint16(portBytes))
+	return host, port, udp, nil
+}
+
+// writeReply sends a SOCKS5 reply with a zeroed-out bind address, for
+// use when there's no real bind address to report (rejections and
+// errors).
+func writeReply(conn net.Conn, rep byte) error {
+	return writeReplyAddr(conn, rep, net.IPv4zero, 0)
+}
+
+// writeReplyAddr sends a SOCKS5 reply carrying the given bind address
+// and port.
+func writeReplyAddr(conn net.Conn, rep byte, ip net.IP, port int) error {
+	atyp := byte(atypIPv4)
+	addrBytes := ip.To4()
+	if addrBytes == nil {
+		atyp = atypIPv6
+		addrBytes = ip.To16()
+	}
+	if addrBytes == nil {
+		atyp = atypIPv4
+		addrBytes = net.IPv4zero.To4()
+	}
+
+	buf := make([]byte, 0, 6+len(addrBytes))
+	buf = append(buf, socksVersion5, rep, 0x00, atyp)
+	buf = append(buf, addrBytes...)
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	buf = append(buf, portBytes...)
+
+	_, err := conn.Write(buf)
+	return err
+}
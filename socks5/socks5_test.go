@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestReadRequestIPv4(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte{socksVersion5, cmdConnect, 0x00, atypIPv4, 127, 0, 0, 1})
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, 443)
+		client.Write(port)
+	}()
+
+	s := &Server{}
+	host, port, udp, err := s.readRequest(server)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", host)
+	assert.Equal(t, 443, port)
+	assert.False(t, udp)
+}
+
+func TestReadRequestDomain(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	domain := "example.com"
+	go func() {
+		client.Write([]byte{socksVersion5, cmdConnect, 0x00, atypDomain, byte(len(domain))})
+		client.Write([]byte(domain))
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, 8080)
+		client.Write(port)
+	}()
+
+	s := &Server{}
+	host, port, udp, err := s.readRequest(server)
+	assert.NoError(t, err)
+	assert.Equal(t, domain, host)
+	assert.Equal(t, 8080, port)
+	assert.False(t, udp)
+}
+
+func TestAllowedPortsOption(t *testing.T) {
+	s := New(nil, AllowedPorts([]int{443, 8080}))
+	assert.True(t, s.allowedPorts[443])
+	assert.True(t, s.allowedPorts[8080])
+	assert.False(t, s.allowedPorts[8081])
+}
+
+func TestDeviceIDFromAddr(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 54321}
+	assert.Equal(t, "203.0.113.5", deviceIDFromAddr(addr))
+}
+
+func TestSocksReplyForRejection(t *testing.T) {
+	assert.Equal(t, byte(repConnNotAllowed), socksReplyFor(403))
+	assert.Equal(t, byte(repGeneralFailure), socksReplyFor(401))
+	assert.Equal(t, byte(repGeneralFailure), socksReplyFor(500))
+}
+
+func TestWriteReplyAddrIPv4(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go writeReplyAddr(server, repSucceeded, net.ParseIP("127.0.0.1"), 443)
+
+	buf := make([]byte, 10)
+	_, err := client.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{socksVersion5, repSucceeded, 0x00, atypIPv4, 127, 0, 0, 1, 0x01, 0xbb}, buf)
+}
@@ -0,0 +1,139 @@
+package tokenfilter
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+// jwtHeader is the minimal JOSE header JWTValidator understands.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+// jwtClaims is the set of claims JWTValidator expects a token to
+// carry: a device id, the subscription tier the device is entitled
+// to, and a standard Unix-seconds expiry. exp is mandatory; a token
+// that omits it is rejected rather than treated as never-expiring.
+type jwtClaims struct {
+	DeviceID string `json:"deviceid"`
+	Tier     string `json:"tier"`
+	Exp      int64  `json:"exp"`
+}
+
+// JWTValidator verifies compact HS256- or EdDSA-signed JWTs carrying
+// deviceid, exp and tier claims. Tokens signed with any other
+// algorithm, expired tokens, and tokens for a tier outside
+// allowedTiers are all rejected; a well-formed but rejected token
+// still reports its deviceid so callers can log it for auditing.
+// Accepted tokens populate ctx's deviceIDKey/tierKey so downstream
+// filters see the same identity the token vouched for.
+//
+// Verification is done directly against the standard library's
+// crypto/hmac and crypto/ed25519 rather than a third-party JWT
+// package: this tree predates that kind of dependency and has no
+// go.mod/vendor manifest to add one to, and the compact JWS format
+// this needs (header.claims.signature, HS256 or EdDSA only) is small
+// enough to verify directly.
+type JWTValidator struct {
+	hmacSecret   []byte
+	ed25519Key   ed25519.PublicKey
+	allowedTiers map[string]bool
+}
+
+// NewJWTValidator constructs a JWTValidator. Either hmacSecret or
+// ed25519Key may be nil to disable that signing method; a token
+// signed with a disabled or unrecognized method is rejected. A nil or
+// empty allowedTiers accepts tokens for any tier.
+func NewJWTValidator(hmacSecret []byte, ed25519Key ed25519.PublicKey, allowedTiers []string) *JWTValidator {
+	v := &JWTValidator{hmacSecret: hmacSecret, ed25519Key: ed25519Key}
+	if len(allowedTiers) > 0 {
+		v.allowedTiers = make(map[string]bool, len(allowedTiers))
+		for _, t := range allowedTiers {
+			v.allowedTiers[t] = true
+		}
+	}
+	return v
+}
+
+// Validate implements TokenValidator.
+func (v *JWTValidator) Validate(ctx filters.Context, token string) (filters.Context, string, bool) {
+	claims, ok := v.verify(token)
+	if !ok {
+		return ctx, "", false
+	}
+	// exp is mandatory: a token minted without one must not be treated
+	// as never-expiring, or it would bypass rotation entirely.
+	if claims.Exp == 0 || time.Now().Unix() >= claims.Exp {
+		return ctx, claims.DeviceID, false
+	}
+	if v.allowedTiers != nil && !v.allowedTiers[claims.Tier] {
+		return ctx, claims.DeviceID, false
+	}
+	ctx = ctx.Put(deviceIDKey, claims.DeviceID)
+	ctx = ctx.Put(tierKey, claims.Tier)
+	return ctx, claims.DeviceID, true
+}
+
+// verify checks token's signature and decodes its claims. It does not
+// check expiry or tier; Validate does that once it knows the claims
+// are genuine.
+func (v *JWTValidator) verify(token string) (*jwtClaims, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, false
+	}
+	signingInput := parts[0] + "." + parts[1]
+
+	switch header.Alg {
+	case "HS256":
+		if v.hmacSecret == nil {
+			return nil, false
+		}
+		mac := hmac.New(sha256.New, v.hmacSecret)
+		mac.Write([]byte(signingInput))
+		if subtle.ConstantTimeCompare(mac.Sum(nil), signature) != 1 {
+			return nil, false
+		}
+	case "EdDSA":
+		if v.ed25519Key == nil {
+			return nil, false
+		}
+		if !ed25519.Verify(v.ed25519Key, []byte(signingInput), signature) {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, false
+	}
+	return &claims, true
+}
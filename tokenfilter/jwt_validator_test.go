@@ -0,0 +1,95 @@
+package tokenfilter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func signHS256(t *testing.T, secret []byte, claims jwtClaims) string {
+	header, err := json.Marshal(jwtHeader{Alg: "HS256"})
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTValidatorVerifiesSignatureAndDecodesClaims(t *testing.T) {
+	// Validate's accept path mutates filters.Context via Put, which
+	// needs a real implementation this tree doesn't have; exercise the
+	// signature verification and claims decoding that gate it instead.
+	secret := []byte("super-secret")
+	exp := time.Now().Add(time.Hour).Unix()
+	token := signHS256(t, secret, jwtClaims{
+		DeviceID: "device-1",
+		Tier:     "pro",
+		Exp:      exp,
+	})
+
+	v := NewJWTValidator(secret, nil, []string{"pro"})
+	claims, ok := v.verify(token)
+	if assert.True(t, ok) {
+		assert.Equal(t, "device-1", claims.DeviceID)
+		assert.Equal(t, "pro", claims.Tier)
+		assert.Equal(t, exp, claims.Exp)
+	}
+}
+
+func TestJWTValidatorRejectsExpired(t *testing.T) {
+	secret := []byte("super-secret")
+	token := signHS256(t, secret, jwtClaims{
+		DeviceID: "device-1",
+		Tier:     "pro",
+		Exp:      time.Now().Add(-time.Hour).Unix(),
+	})
+
+	v := NewJWTValidator(secret, nil, nil)
+	_, deviceID, allowed := v.Validate(nil, token)
+	assert.False(t, allowed)
+	assert.Equal(t, "device-1", deviceID, "expired-but-well-formed token should still report its deviceid for auditing")
+}
+
+func TestJWTValidatorRejectsMissingExpiry(t *testing.T) {
+	secret := []byte("super-secret")
+	token := signHS256(t, secret, jwtClaims{DeviceID: "device-1", Tier: "pro"})
+
+	v := NewJWTValidator(secret, nil, nil)
+	_, deviceID, allowed := v.Validate(nil, token)
+	assert.False(t, allowed, "a token without an exp claim must not be treated as never-expiring")
+	assert.Equal(t, "device-1", deviceID)
+}
+
+func TestJWTValidatorRejectsWrongTier(t *testing.T) {
+	secret := []byte("super-secret")
+	token := signHS256(t, secret, jwtClaims{
+		DeviceID: "device-1",
+		Tier:     "free",
+		Exp:      time.Now().Add(time.Hour).Unix(),
+	})
+
+	v := NewJWTValidator(secret, nil, []string{"pro"})
+	_, deviceID, allowed := v.Validate(nil, token)
+	assert.False(t, allowed)
+	assert.Equal(t, "device-1", deviceID)
+}
+
+func TestJWTValidatorRejectsBadSignature(t *testing.T) {
+	token := signHS256(t, []byte("super-secret"), jwtClaims{DeviceID: "device-1", Exp: time.Now().Add(time.Hour).Unix()})
+
+	v := NewJWTValidator([]byte("different-secret"), nil, nil)
+	_, _, allowed := v.Validate(nil, token)
+	assert.False(t, allowed)
+}
@@ -0,0 +1,70 @@
+package tokenfilter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+// MultiStaticValidator accepts any token from a fixed set of
+// currently-valid tokens, plus tokens from a previous set that are
+// still honored until a grace deadline, so operators can roll proxy
+// tokens without requiring every client to pick up the new one at
+// exactly the same moment.
+type MultiStaticValidator struct {
+	mu    sync.RWMutex
+	valid map[string]bool
+	grace map[string]time.Time
+}
+
+// NewMultiStaticValidator constructs a MultiStaticValidator accepting
+// validTokens. graceTokens continue to be accepted until graceExpiry;
+// use Rotate to roll in a new valid set and put the old one on a
+// fresh grace period.
+func NewMultiStaticValidator(validTokens []string, graceTokens []string, graceExpiry time.Time) *MultiStaticValidator {
+	grace := make(map[string]time.Time, len(graceTokens))
+	for _, t := range graceTokens {
+		grace[t] = graceExpiry
+	}
+	return &MultiStaticValidator{
+		valid: toTokenSet(validTokens),
+		grace: grace,
+	}
+}
+
+func toTokenSet(tokens []string) map[string]bool {
+	set := make(map[string]bool, len(tokens))
+	for _, t := range tokens {
+		set[t] = true
+	}
+	return set
+}
+
+// Validate implements TokenValidator. It never augments ctx or
+// identifies a device, since a static token carries no such claims.
+func (v *MultiStaticValidator) Validate(ctx filters.Context, token string) (filters.Context, string, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if v.valid[token] {
+		return ctx, "", true
+	}
+	if expiry, ok := v.grace[token]; ok && time.Now().Before(expiry) {
+		return ctx, "", true
+	}
+	return ctx, "", false
+}
+
+// Rotate replaces the valid token set with newTokens, moving the
+// previous valid set into the grace set until graceDuration elapses
+// so clients that haven't yet picked up a new token keep working in
+// the meantime.
+func (v *MultiStaticValidator) Rotate(newTokens []string, graceDuration time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	expiry := time.Now().Add(graceDuration)
+	for t := range v.valid {
+		v.grace[t] = expiry
+	}
+	v.valid = toTokenSet(newTokens)
+}
@@ -0,0 +1,39 @@
+package tokenfilter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestMultiStaticValidator(t *testing.T) {
+	v := NewMultiStaticValidator([]string{"new-token"}, []string{"old-token"}, time.Now().Add(time.Minute))
+
+	_, _, allowed := v.Validate(nil, "new-token")
+	assert.True(t, allowed, "currently-valid token should be allowed")
+
+	_, _, allowed = v.Validate(nil, "old-token")
+	assert.True(t, allowed, "token within its grace period should still be allowed")
+
+	_, _, allowed = v.Validate(nil, "unknown-token")
+	assert.False(t, allowed, "unrecognized token should be rejected")
+}
+
+func TestMultiStaticValidatorGraceExpires(t *testing.T) {
+	v := NewMultiStaticValidator([]string{"new-token"}, []string{"old-token"}, time.Now().Add(-time.Minute))
+
+	_, _, allowed := v.Validate(nil, "old-token")
+	assert.False(t, allowed, "token past its grace deadline should be rejected")
+}
+
+func TestMultiStaticValidatorRotate(t *testing.T) {
+	v := NewMultiStaticValidator([]string{"token-a"}, nil, time.Time{})
+	v.Rotate([]string{"token-b"}, time.Minute)
+
+	_, _, allowed := v.Validate(nil, "token-b")
+	assert.True(t, allowed, "newly rotated-in token should be allowed")
+
+	_, _, allowed = v.Validate(nil, "token-a")
+	assert.True(t, allowed, "token rotated out should still be allowed during its grace period")
+}
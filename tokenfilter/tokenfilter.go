@@ -17,14 +17,40 @@ import (
 
 var log = golog.LoggerFor("tokenfilter")
 
+// deviceIDKey and tierKey are the filters.Context keys a TokenValidator
+// populates from a token's claims, so that downstream filters (such as
+// the redis reporter's "deviceid" lookup) key on the same identity the
+// token authenticated rather than
+// whatever metadata they'd otherwise derive on their own.
+const (
+	deviceIDKey = "deviceid"
+	tierKey     = "tier"
+)
+
+// TokenValidator decides whether a token presented in
+// common.TokenHeader should be let through. It may return an
+// augmented filters.Context carrying claims the token proved (such as
+// a device id), for downstream filters to key on. deviceID, when
+// returned non-empty on a rejected token, identifies a well-formed
+// but unauthorized token for audit logging; it's ignored otherwise.
+type TokenValidator interface {
+	Validate(ctx filters.Context, token string) (newCtx filters.Context, deviceID string, allowed bool)
+}
+
 type tokenFilter struct {
-	token      string
+	validator  TokenValidator
 	instrument instrument.Instrument
 }
 
-func New(token string, instrument instrument.Instrument) filters.Filter {
+// New constructs a filter that checks common.TokenHeader against
+// validator. A request with no token, or one validator rejects, is
+// handed to mimicApache so the proxy looks like a stock Apache
+// install to anyone probing it. A nil validator matches the filter's
+// original behavior with an empty token: every request passes
+// unchecked.
+func New(validator TokenValidator, instrument instrument.Instrument) filters.Filter {
 	return &tokenFilter{
-		token:      token,
+		validator:  validator,
 		instrument: instrument,
 	}
 }
@@ -38,30 +64,31 @@ func (f *tokenFilter) Apply(ctx filters.Context, req *http.Request, next filters
 		log.Tracef("Token Filter Middleware received request:\n%s", reqStr)
 	}
 
-	if f.token == "" {
+	if f.validator == nil {
 		log.Trace("Not checking token")
 		return next(ctx, req)
 	}
 
 	tokens := req.Header[common.TokenHeader]
-	if tokens == nil || len(tokens) == 0 || tokens[0] == "" {
+	if len(tokens) == 0 || tokens[0] == "" {
 		log.Error(errorf(op, "No token provided, mimicking apache"))
 		f.instrument.Mimic(true)
 		return mimicApache(ctx, req)
 	}
-	tokenMatched := false
+
 	for _, candidate := range tokens {
-		if candidate == f.token {
-			tokenMatched = true
-			break
+		newCtx, deviceID, allowed := f.validator.Validate(ctx, candidate)
+		if allowed {
+			req.Header.Del(common.TokenHeader)
+			log.Tracef("Allowing connection from %v to %v", req.RemoteAddr, req.Host)
+			f.instrument.Mimic(false)
+			return next(newCtx, req)
+		}
+		if deviceID != "" {
+			log.Errorf("Rejecting unauthorized token for device %v", deviceID)
 		}
 	}
-	if tokenMatched {
-		req.Header.Del(common.TokenHeader)
-		log.Tracef("Allowing connection from %v to %v", req.RemoteAddr, req.Host)
-		f.instrument.Mimic(false)
-		return next(ctx, req)
-	}
+
 	log.Error(errorf(op, "Mismatched token(s) %v, mimicking apache", strings.Join(tokens, ",")))
 	f.instrument.Mimic(true)
 	return mimicApache(ctx, req)
@@ -15,13 +15,21 @@
 // It doesn't check other HTTP methods.
 //
 // The purpose is to show an upgrade notice to the users with outdated Lantern
-// client.
+// client. Besides the original hard redirect, a Rule can instead ask for a
+// soft Warn: rather than yanking a working session to the upgrade page, an
+// X-Lantern-Upgrade-Available response header (or, for CONNECT, the same
+// header on the 200 Connection Established line) is injected and the
+// request proceeds, letting the client show an in-app banner on its own
+// schedule. A Block Behavior is also available for versions operators want
+// to refuse outright.
 //
 package versioncheck
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -46,8 +54,50 @@ var (
 
 const (
 	oneMillion = 100 * 100 * 100
+
+	upgradeHeader = "X-Lantern-Upgrade-Available"
+)
+
+// Behavior is the action VersionChecker takes against a request whose
+// X-Lantern-Version matches.
+type Behavior int
+
+const (
+	// Redirect is the original behavior: a 302 Found for GET, or an
+	// acked-then-redirected response for CONNECT. It ends the request.
+	Redirect Behavior = iota
+	// Warn injects an upgradeHeader and lets the request proceed.
+	Warn
+	// Block refuses the request with a 403 Forbidden.
+	Block
+)
+
+// Severity is reported in the upgradeHeader so a client can decide how
+// insistently to prompt the user to upgrade.
+type Severity string
+
+const (
+	SeverityWarn     Severity = "warn"
+	SeverityCritical Severity = "critical"
 )
 
+// Rule overrides the Behavior (and, for Warn, the Severity) applied to
+// requests whose X-Lantern-Version falls within VersionRange. Rules are
+// tried in the order given to WithRules; the first matching range wins.
+// A request matching none of them falls back to New's own versionRange
+// gate and default Behavior.
+type Rule struct {
+	VersionRange string
+	Behavior     Behavior
+	Severity     Severity
+}
+
+type compiledRule struct {
+	versionRange semver.Range
+	behavior     Behavior
+	severity     Severity
+}
+
 type VersionChecker struct {
 	versionRange     semver.Range
 	rewriteURL       *url.URL
@@ -55,12 +105,53 @@ type VersionChecker struct {
 	rewriteAddr      string
 	tunnelPorts      []string
 	ppm              int
+
+	latestVersion string
+	behavior      Behavior
+	severity      Severity
+	rules         []compiledRule
+}
+
+// Option configures optional, per-version-range behavior on top of
+// New's default Redirect Behavior.
+type Option func(*VersionChecker) error
+
+// WithBehavior sets the Behavior (and, for Warn, Severity) applied to
+// any matching request that isn't covered by a more specific Rule
+// installed via WithRules. It defaults to Redirect.
+func WithBehavior(behavior Behavior, severity Severity) Option {
+	return func(c *VersionChecker) error {
+		c.behavior = behavior
+		c.severity = severity
+		return nil
+	}
+}
+
+// WithRules installs per-version-range overrides of the default
+// Behavior, and sets the version reported as "latest" in the
+// upgradeHeader for Warn responses.
+func WithRules(latestVersion string, rules []Rule) Option {
+	return func(c *VersionChecker) error {
+		c.latestVersion = latestVersion
+		compiled := make([]compiledRule, 0, len(rules))
+		for _, r := range rules {
+			ver, err := semver.ParseRange(r.VersionRange)
+			if err != nil {
+				return fmt.Errorf("invalid version range %q: %v", r.VersionRange, err)
+			}
+			compiled = append(compiled, compiledRule{ver, r.Behavior, r.Severity})
+		}
+		c.rules = compiled
+		return nil
+	}
 }
 
 // New constructs a VersionChecker to check the request and rewrite/redirect if
 // required.  It errors if the versionRange string is not valid, or the rewrite
-// URL is malformed. tunnelPortsToCheck defaults to 80 only.
-func New(versionRange string, rewriteURL string, tunnelPortsToCheck []string, percentage float64) (*VersionChecker, error) {
+// URL is malformed. tunnelPortsToCheck defaults to 80 only. By default a
+// matching request is handled with Behavior Redirect; pass WithBehavior
+// and/or WithRules to change that.
+func New(versionRange string, rewriteURL string, tunnelPortsToCheck []string, percentage float64, options ...Option) (*VersionChecker, error) {
 	u, err := url.Parse(rewriteURL)
 	if err != nil {
 		return nil, err
@@ -78,7 +169,22 @@ func New(versionRange string, rewriteURL string, tunnelPortsToCheck []string, pe
 	if err != nil {
 		return nil, err
 	}
-	return &VersionChecker{ver, u, rewriteURL, rewriteAddr, tunnelPortsToCheck, int(percentage * oneMillion)}, nil
+	c := &VersionChecker{
+		versionRange:     ver,
+		rewriteURL:       u,
+		rewriteURLString: rewriteURL,
+		rewriteAddr:      rewriteAddr,
+		tunnelPorts:      tunnelPortsToCheck,
+		ppm:              int(percentage * oneMillion),
+		behavior:         Redirect,
+		severity:         SeverityWarn,
+	}
+	for _, opt := range options {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
 }
 
 // Dial is a function that dials a network connection.
@@ -112,18 +218,70 @@ func (c *VersionChecker) Apply(ctx filters.Context, req *http.Request, next filt
 	defer req.Header.Del(common.VersionHeader)
 	switch req.Method {
 	case http.MethodConnect:
-		if c.shouldRedirectOnConnect(req) {
-			return c.redirectOnConnect(ctx, req)
+		if c.shouldActOnConnect(req) {
+			behavior, severity := c.behaviorFor(req)
+			return c.actOnConnect(ctx, req, next, behavior, severity)
 		}
 	case http.MethodGet:
 		// the first request from browser should always be GET
-		if c.shouldRedirect(req) {
-			return c.redirect(ctx, req)
+		if c.shouldAct(req) {
+			behavior, severity := c.behaviorFor(req)
+			return c.act(ctx, req, next, behavior, severity)
 		}
 	}
 	return next(ctx, req)
 }
 
+// behaviorFor returns the Behavior and Severity to apply to req, preferring
+// the first Rule whose VersionRange matches req's X-Lantern-Version over
+// VersionChecker's own default.
+func (c *VersionChecker) behaviorFor(req *http.Request) (Behavior, Severity) {
+	if v, err := semver.Make(req.Header.Get(common.VersionHeader)); err == nil {
+		for _, r := range c.rules {
+			if r.versionRange(v) {
+				return r.behavior, r.severity
+			}
+		}
+	}
+	return c.behavior, c.severity
+}
+
+func (c *VersionChecker) act(ctx filters.Context, req *http.Request, next filters.Next, behavior Behavior, severity Severity) (*http.Response, filters.Context, error) {
+	switch behavior {
+	case Block:
+		return c.block(ctx, req)
+	case Warn:
+		resp, ctx, err := next(ctx, req)
+		if err == nil && resp != nil {
+			setUpgradeHeader(resp.Header, c.latestVersion, c.rewriteURLString, severity)
+		}
+		return resp, ctx, err
+	default:
+		return c.redirect(ctx, req)
+	}
+}
+
+func (c *VersionChecker) actOnConnect(ctx filters.Context, req *http.Request, next filters.Next, behavior Behavior, severity Severity) (*http.Response, filters.Context, error) {
+	switch behavior {
+	case Block:
+		return c.block(ctx, req)
+	case Warn:
+		return c.warnOnConnect(ctx, req, next, severity)
+	default:
+		return c.redirectOnConnect(ctx, req)
+	}
+}
+
+func (c *VersionChecker) block(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+	log.Debugf("Blocking outdated client %s %s%s", req.Method, req.Host, req.URL.Path)
+	return &http.Response{
+		StatusCode: http.StatusForbidden,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Close:      true,
+	}, ctx, nil
+}
+
 func (c *VersionChecker) redirect(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
 	log.Debugf("Redirecting %s %s%s to %s",
 		req.Method,
@@ -142,7 +300,82 @@ func (c *VersionChecker) redirect(ctx filters.Context, req *http.Request) (*http
 	}, ctx, nil
 }
 
-func (c *VersionChecker) shouldRedirect(req *http.Request) bool {
+// warnOnConnect lets the CONNECT proceed through the rest of the chain
+// exactly as an unmatched request would - so the real tunnel dialer
+// still owns dialing the origin, acking the CONNECT and metering the
+// copy - except the downstream conn it hands to next is wrapped so
+// that whatever ack it writes gets the upgrade header folded into its
+// "200 Connection Established" line on the way out.
+func (c *VersionChecker) warnOnConnect(ctx filters.Context, req *http.Request, next filters.Next, severity Severity) (*http.Response, filters.Context, error) {
+	header := http.Header{}
+	setUpgradeHeader(header, c.latestVersion, c.rewriteURLString, severity)
+
+	injectingConn := &ackHeaderInjectingConn{Conn: ctx.DownstreamConn(), extra: header}
+	return next(&downstreamConnOverride{Context: ctx, conn: injectingConn}, req)
+}
+
+// downstreamConnOverride overrides only DownstreamConn on an existing
+// filters.Context, so the rest of the chain keeps seeing every other
+// piece of context (tracing, device id, etc.) unchanged.
+type downstreamConnOverride struct {
+	filters.Context
+	conn net.Conn
+}
+
+func (o *downstreamConnOverride) DownstreamConn() net.Conn {
+	return o.conn
+}
+
+// ackHeaderInjectingConn buffers writes until it has seen a full set
+// of HTTP headers (a blank line), folds extra into them, flushes the
+// rewritten header block, and then passes every subsequent write
+// straight through unmodified. This lets a filter fold extra response
+// headers into an ack it doesn't otherwise control the writing of,
+// regardless of how many Write calls the real writer splits the
+// status line and headers across.
+type ackHeaderInjectingConn struct {
+	net.Conn
+	extra    http.Header
+	buf      bytes.Buffer
+	injected bool
+}
+
+func (c *ackHeaderInjectingConn) Write(b []byte) (int, error) {
+	if c.injected {
+		return c.Conn.Write(b)
+	}
+	c.buf.Write(b)
+	idx := bytes.Index(c.buf.Bytes(), []byte("\r\n\r\n"))
+	if idx < 0 {
+		return len(b), nil
+	}
+
+	head := c.buf.Bytes()[:idx]
+	rest := append([]byte{}, c.buf.Bytes()[idx+4:]...)
+
+	out := append([]byte{}, head...)
+	out = append(out, '\r', '\n')
+	for k, vs := range c.extra {
+		for _, v := range vs {
+			out = append(out, []byte(k+": "+v+"\r\n")...)
+		}
+	}
+	out = append(out, '\r', '\n')
+	out = append(out, rest...)
+
+	c.injected = true
+	c.buf.Reset()
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func setUpgradeHeader(h http.Header, latestVersion string, rewriteURL string, severity Severity) {
+	h.Set(upgradeHeader, fmt.Sprintf("%s; url=%s; severity=%s", latestVersion, rewriteURL, severity))
+}
+
+func (c *VersionChecker) shouldAct(req *http.Request) bool {
 	// Typical browsers always have this as the first value
 	if !strings.HasPrefix(req.Header.Get("Accept"), "text/html") {
 		return false
@@ -154,7 +387,7 @@ func (c *VersionChecker) shouldRedirect(req *http.Request) bool {
 	return c.matchVersion(req)
 }
 
-func (c *VersionChecker) shouldRedirectOnConnect(req *http.Request) bool {
+func (c *VersionChecker) shouldActOnConnect(req *http.Request) bool {
 	if !c.matchVersion(req) {
 		return false
 	}
@@ -208,7 +441,12 @@ func (c *VersionChecker) matchVersion(req *http.Request) bool {
 	}
 	version := req.Header.Get(common.VersionHeader)
 	v, e := semver.Make(version)
-	if e == nil && !c.versionRange(v) {
+	// A version outside versionRange still matches if some Rule's own
+	// VersionRange covers it - otherwise a Block/Warn Rule scoped to
+	// versions outside the global gate (e.g. older than it, to refuse
+	// clients New's default Redirect was never meant to cover) would
+	// never be consulted at all.
+	if e == nil && !c.versionRange(v) && !c.matchesRule(v) {
 		return false
 	}
 	if random.Intn(oneMillion) >= c.ppm {
@@ -216,3 +454,13 @@ func (c *VersionChecker) matchVersion(req *http.Request) bool {
 	}
 	return true
 }
+
+// matchesRule reports whether any Rule installed via WithRules covers v.
+func (c *VersionChecker) matchesRule(v semver.Version) bool {
+	for _, r := range c.rules {
+		if r.versionRange(v) {
+			return true
+		}
+	}
+	return false
+}
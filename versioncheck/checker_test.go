@@ -0,0 +1,88 @@
+package versioncheck
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/getlantern/testify/assert"
+
+	"github.com/getlantern/http-proxy-lantern/common"
+)
+
+type nopConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *nopConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+
+func TestRuleAppliesOutsideGlobalVersionRange(t *testing.T) {
+	// The global versionRange only covers >=3.0.0, but the Block Rule
+	// targets clients older than 1.0.0 - well outside it. It must still
+	// fire rather than being silently skipped because matchVersion's
+	// global gate rejected the request first.
+	c, err := New(">=3.0.0", "https://example.com/upgrade", nil, 1.0, WithRules("3.0.0", []Rule{
+		{VersionRange: "<1.0.0", Behavior: Block},
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodConnect, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Host = "origin.example:80"
+	req.Header.Set(common.VersionHeader, "0.9.0")
+
+	called := false
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		called = true
+		return nil, ctx, nil
+	}
+
+	resp, _, err := c.Apply(filters.NewContext(&nopConn{}), req, next)
+	assert.NoError(t, err)
+	assert.False(t, called, "Block should short-circuit the chain")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestAckHeaderInjectingConnSingleWrite(t *testing.T) {
+	underlying := &nopConn{}
+	extra := http.Header{}
+	extra.Set(upgradeHeader, "2.0.0; url=https://example.com/upgrade; severity=warn")
+	c := &ackHeaderInjectingConn{Conn: underlying, extra: extra}
+
+	n, err := c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 39, n)
+	assert.Contains(t, underlying.buf.String(), "HTTP/1.1 200 Connection Established\r\n")
+	assert.Contains(t, underlying.buf.String(), upgradeHeader+": 2.0.0; url=https://example.com/upgrade; severity=warn\r\n")
+	assert.Contains(t, underlying.buf.String(), "\r\n\r\n")
+}
+
+func TestAckHeaderInjectingConnSplitAcrossWrites(t *testing.T) {
+	underlying := &nopConn{}
+	extra := http.Header{}
+	extra.Set(upgradeHeader, "2.0.0; url=https://example.com/upgrade; severity=critical")
+	c := &ackHeaderInjectingConn{Conn: underlying, extra: extra}
+
+	_, err := c.Write([]byte("HTTP/1.1 200 Connection Established\r\n"))
+	assert.NoError(t, err)
+	assert.Empty(t, underlying.buf.String(), "nothing should be flushed before the header terminator is seen")
+
+	_, err = c.Write([]byte("\r\n"))
+	assert.NoError(t, err)
+	assert.Contains(t, underlying.buf.String(), upgradeHeader+": 2.0.0; url=https://example.com/upgrade; severity=critical\r\n")
+
+	// Once the headers are flushed, subsequent writes (the tunneled
+	// body) pass straight through unmodified.
+	_, err = c.Write([]byte("raw tunnel bytes"))
+	assert.NoError(t, err)
+	assert.Contains(t, underlying.buf.String(), "raw tunnel bytes")
+}